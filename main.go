@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/cmd"
 	dnsv1 "github.com/xzzpig/kube-dns-manager/api/dns/v1"
@@ -19,6 +27,22 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// defaultTTL is written to dnsRecord.Spec.TTL when the issuer config omits it.
+const defaultTTL = 60
+
+// defaultPollingInterval is used while waiting out PropagationTimeout when
+// the issuer config doesn't specify its own PollingInterval.
+const defaultPollingInterval = 2 * time.Second
+
+// readyConditionType is the Record status condition Present polls for once
+// a PropagationTimeout is configured.
+const readyConditionType = "Ready"
+
+// solversConfigEnvVar names the env var pointing at a YAML file listing the
+// named solver instances to register. When unset, a single solver named
+// "kube-dns-manager" is registered, matching prior behaviour.
+const solversConfigEnvVar = "SOLVERS_CONFIG"
+
 var GroupName = os.Getenv("GROUP_NAME")
 
 func main() {
@@ -26,14 +50,60 @@ func main() {
 		panic("GROUP_NAME must be specified")
 	}
 
-	// This will register our custom DNS provider with the webhook serving
-	// library, making it available as an API under the provided GroupName.
+	solvers, err := loadSolvers()
+	if err != nil {
+		panic(err)
+	}
+
+	// This will register our custom DNS provider(s) with the webhook serving
+	// library, making them available as an API under the provided GroupName.
 	// You can register multiple DNS provider implementations with a single
 	// webhook, where the Name() method will be used to disambiguate between
 	// the different implementations.
-	cmd.RunWebhookServer(GroupName,
-		&customDNSProviderSolver{},
-	)
+	cmd.RunWebhookServer(GroupName, solvers...)
+}
+
+// solverDefaults describes one named solver instance read from
+// SOLVERS_CONFIG: its Name() and the defaults applied to every challenge it
+// handles, with any matching field set on the per-issuer
+// customDNSProviderConfig taking precedence.
+type solverDefaults struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+	ProviderRef *objectReference  `json:"providerRef,omitempty"`
+}
+
+// loadSolvers reads SOLVERS_CONFIG, if set, and builds one
+// customDNSProviderSolver per listed entry. When the env var is unset it
+// falls back to a single solver named "kube-dns-manager".
+func loadSolvers() ([]webhook.Solver, error) {
+	path := os.Getenv(solversConfigEnvVar)
+	if path == "" {
+		return []webhook.Solver{&customDNSProviderSolver{name: "kube-dns-manager"}}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", solversConfigEnvVar, err)
+	}
+
+	var defs []solverDefaults
+	if err := yaml.Unmarshal(raw, &defs); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", solversConfigEnvVar, err)
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("%s must list at least one solver", solversConfigEnvVar)
+	}
+
+	solvers := make([]webhook.Solver, 0, len(defs))
+	for _, def := range defs {
+		if def.Name == "" {
+			return nil, fmt.Errorf("%s: every solver entry requires a name", solversConfigEnvVar)
+		}
+		solvers = append(solvers, &customDNSProviderSolver{name: def.Name, defaults: def})
+	}
+	return solvers, nil
 }
 
 // customDNSProviderSolver implements the provider-specific logic needed to
@@ -48,6 +118,15 @@ type customDNSProviderSolver struct {
 	// 4. ensure your webhook's service account has the required RBAC role
 	//    assigned to it for interacting with the Kubernetes APIs you need.
 	client client.Client
+
+	// name is returned by Name(), letting multiple solver instances backed by
+	// different kube-dns-manager provider selectors be registered and
+	// disambiguated on the ACME Issuer's solvers[].dns01.webhook.solverName.
+	name string
+	// defaults are applied to every challenge this solver instance handles,
+	// with the per-issuer customDNSProviderConfig winning on a field-by-field
+	// basis.
+	defaults solverDefaults
 }
 
 // customDNSProviderConfig is a structure that is used to decode into when
@@ -67,6 +146,46 @@ type customDNSProviderSolver struct {
 type customDNSProviderConfig struct {
 	Labels map[string]string `json:"labels"`
 	Extra  map[string]string `json:"extra"`
+
+	// TTL is the TTL, in seconds, written to the Record's spec. Defaults to
+	// defaultTTL when unset.
+	TTL int `json:"ttl"`
+
+	// PropagationTimeout bounds how long Present waits for kube-dns-manager
+	// to report the Record as synced to the upstream provider before
+	// returning an error for cert-manager to retry. Leaving it unset (the
+	// zero value) preserves the previous fire-and-forget behaviour.
+	PropagationTimeout metav1.Duration `json:"propagationTimeout,omitempty"`
+
+	// PollingInterval controls how often the Record's status is re-checked
+	// while waiting out PropagationTimeout. Defaults to defaultPollingInterval.
+	PollingInterval metav1.Duration `json:"pollingInterval,omitempty"`
+
+	// ProviderRef and ZoneRef select which kube-dns-manager provider/zone the
+	// Record should be created against, instead of stuffing that selection
+	// into Extra.
+	ProviderRef *objectReference `json:"providerRef,omitempty"`
+	ZoneRef     *objectReference `json:"zoneRef,omitempty"`
+
+	// CNAMEDelegation, when set, writes the challenge Record into a
+	// dedicated acme zone instead of the literal resolved FQDN, so operators
+	// can delegate `_acme-challenge.*` to a zone kube-dns-manager actually
+	// controls via a static CNAME.
+	CNAMEDelegation *cnameDelegationConfig `json:"cnameDelegation,omitempty"`
+}
+
+// cnameDelegationConfig points challenge records at targetZone (optionally
+// under subdomain) rather than the FQDN cert-manager resolved.
+type cnameDelegationConfig struct {
+	TargetZone string `json:"targetZone"`
+	Subdomain  string `json:"subdomain,omitempty"`
+}
+
+// objectReference names a namespaced kube-dns-manager resource, such as the
+// Provider or Zone a Record should be created against.
+type objectReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
 }
 
 // Name is used as the name for this DNS solver when referencing it on the ACME
@@ -76,9 +195,28 @@ type customDNSProviderConfig struct {
 // within a single webhook deployment**.
 // For example, `cloudflare` may be used as the name of a solver.
 func (c *customDNSProviderSolver) Name() string {
+	if c.name != "" {
+		return c.name
+	}
 	return "kube-dns-manager"
 }
 
+// applyDefaults fills any Labels, Extra, or ProviderRef left unset on cfg
+// with this solver instance's configured defaults. Fields explicitly set on
+// the per-issuer config always win.
+func (c *customDNSProviderSolver) applyDefaults(cfg customDNSProviderConfig) customDNSProviderConfig {
+	if cfg.Labels == nil {
+		cfg.Labels = c.defaults.Labels
+	}
+	if cfg.Extra == nil {
+		cfg.Extra = c.defaults.Extra
+	}
+	if cfg.ProviderRef == nil {
+		cfg.ProviderRef = c.defaults.ProviderRef
+	}
+	return cfg
+}
+
 // Present is responsible for actually presenting the DNS record with the
 // DNS provider.
 // This method should tolerate being called multiple times with the same value.
@@ -92,10 +230,20 @@ func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
 		klog.ErrorS(err, "Failed to load solver configuration")
 		return err
 	}
+	cfg = c.applyDefaults(cfg)
+
+	targetFQDN := delegatedFQDN(strings.TrimSuffix(ch.ResolvedFQDN, "."), cfg.CNAMEDelegation)
+	if cfg.CNAMEDelegation != nil {
+		klog.InfoS("Resolved CNAME delegation target", "fqdn", ch.ResolvedFQDN, "target", targetFQDN)
+	}
 
 	ctx := context.Background()
 	dnsRecord := dnsv1.Record{}
-	dnsRecord.Name = getRecordName(ch.ResolvedFQDN)
+	// Each challenge gets its own Record CR, suffixed with a short hash of
+	// its key, so that concurrent challenges sharing the same FQDN (e.g. a
+	// wildcard and its apex) each get their own TXT value instead of
+	// clobbering a single shared Record.
+	dnsRecord.Name = recordNameForChallenge(targetFQDN, ch.Key)
 	if err := c.client.Get(ctx, client.ObjectKey{Namespace: ch.ResourceNamespace, Name: dnsRecord.Name}, &dnsRecord); client.IgnoreNotFound(err) != nil {
 		klog.ErrorS(err, "Failed to get DNS record", "fqdn", ch.ResolvedFQDN, "uid", ch.UID, "namespace", ch.ResourceNamespace)
 		return err
@@ -103,14 +251,20 @@ func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
 
 	dnsRecord.Namespace = ch.ResourceNamespace
 	dnsRecord.Labels = cfg.Labels
-	dnsRecord.Spec.Name = ch.ResolvedFQDN
+	dnsRecord.Spec.Name = targetFQDN
 	dnsRecord.Spec.Type = "TXT"
 	dnsRecord.Spec.Value = ch.Key
 	dnsRecord.Spec.Extra = cfg.Extra
 
-	// remove trailing dot
-	if strings.HasSuffix(ch.ResolvedFQDN, ".") {
-		dnsRecord.Spec.Name = ch.ResolvedFQDN[:len(ch.ResolvedFQDN)-1]
+	dnsRecord.Spec.TTL = cfg.TTL
+	if dnsRecord.Spec.TTL == 0 {
+		dnsRecord.Spec.TTL = defaultTTL
+	}
+	if cfg.ProviderRef != nil {
+		dnsRecord.Spec.ProviderRef = dnsv1.ObjectReference{Name: cfg.ProviderRef.Name, Namespace: cfg.ProviderRef.Namespace}
+	}
+	if cfg.ZoneRef != nil {
+		dnsRecord.Spec.ZoneRef = dnsv1.ObjectReference{Name: cfg.ZoneRef.Name, Namespace: cfg.ZoneRef.Namespace}
 	}
 
 	if dnsRecord.UID == "" {
@@ -124,9 +278,35 @@ func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
 			return err
 		}
 	}
+
+	if cfg.PropagationTimeout.Duration > 0 {
+		if err := c.waitForPropagation(ctx, &dnsRecord, cfg); err != nil {
+			klog.ErrorS(err, "Timed out waiting for DNS record to propagate", "fqdn", ch.ResolvedFQDN, "uid", ch.UID, "namespace", ch.ResourceNamespace)
+			return err
+		}
+	}
 	return nil
 }
 
+// waitForPropagation polls the Record's status until kube-dns-manager reports
+// it as Ready, or cfg.PropagationTimeout elapses.
+func (c *customDNSProviderSolver) waitForPropagation(ctx context.Context, dnsRecord *dnsv1.Record, cfg customDNSProviderConfig) error {
+	interval := cfg.PollingInterval.Duration
+	if interval <= 0 {
+		interval = defaultPollingInterval
+	}
+
+	key := client.ObjectKeyFromObject(dnsRecord)
+	return wait.PollUntilContextTimeout(ctx, interval, cfg.PropagationTimeout.Duration, true, func(ctx context.Context) (bool, error) {
+		if err := c.client.Get(ctx, key, dnsRecord); err != nil {
+			return false, err
+		}
+		ready := apimeta.IsStatusConditionTrue(dnsRecord.Status.Conditions, readyConditionType)
+		klog.V(4).InfoS("Polling DNS record propagation", "name", key.Name, "namespace", key.Namespace, "ready", ready)
+		return ready, nil
+	})
+}
+
 // CleanUp should delete the relevant TXT record from the DNS provider console.
 // If multiple TXT records exist with the same record name (e.g.
 // _acme-challenge.example.com) then **only** the record with the same `key`
@@ -141,10 +321,17 @@ func (c *customDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) (e erro
 		}
 	}()
 
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		return err
+	}
+	cfg = c.applyDefaults(cfg)
+
 	ctx := context.Background()
+	targetFQDN := delegatedFQDN(strings.TrimSuffix(ch.ResolvedFQDN, "."), cfg.CNAMEDelegation)
 
 	dnsRecord := dnsv1.Record{}
-	dnsRecord.Name = getRecordName(ch.ResolvedFQDN)
+	dnsRecord.Name = recordNameForChallenge(targetFQDN, ch.Key)
 	if err := c.client.Get(ctx, client.ObjectKey{Namespace: ch.ResourceNamespace, Name: dnsRecord.Name}, &dnsRecord); err != nil {
 		return client.IgnoreNotFound(err)
 	}
@@ -187,12 +374,57 @@ func loadConfig(cfgJSON *extapi.JSON) (customDNSProviderConfig, error) {
 		return cfg, fmt.Errorf("error decoding solver config: %v", err)
 	}
 
+	if cfg.CNAMEDelegation != nil && cfg.CNAMEDelegation.TargetZone == "" {
+		return cfg, fmt.Errorf("cnameDelegation.targetZone must not be empty when cnameDelegation is set")
+	}
+
 	return cfg, nil
 }
 
 func getRecordName(fqdn string) string {
+	return "acme-" + sanitizeDNSLabel(fqdn)
+}
+
+// sanitizeDNSLabel lowercases fqdn, replaces every character that can't
+// appear in a Kubernetes object name or DNS label with a dash, and trims
+// leading/trailing dashes so the result never starts or ends with one (both
+// RFC 1123 names and DNS labels forbid that).
+func sanitizeDNSLabel(fqdn string) string {
 	fqdn = strings.ToLower(fqdn)
 	fqdn = regexp.MustCompile(`[^a-z0-9-]`).ReplaceAllString(fqdn, "-")
-	fqdn = strings.TrimRight(fqdn, "-")
-	return "acme-" + fqdn
+	return strings.Trim(fqdn, "-")
+}
+
+// delegatedFQDN returns the FQDN Present/CleanUp should write and look up
+// when cnameDelegation is configured: fqdn with each of its labels
+// sanitized individually (preserving the original dot-separated structure,
+// rather than flattening it into one label) nested under
+// delegation.Subdomain (if any) and delegation.TargetZone. Sanitizing
+// per-label, instead of sanitizing the whole FQDN at once, avoids collapsing
+// the dots that keep different domains (and realistic multi-level FQDNs)
+// from colliding on the same delegated name. Returns fqdn unchanged when
+// delegation is nil.
+func delegatedFQDN(fqdn string, delegation *cnameDelegationConfig) string {
+	if delegation == nil {
+		return fqdn
+	}
+	labels := strings.Split(fqdn, ".")
+	for i, label := range labels {
+		labels[i] = sanitizeDNSLabel(label)
+	}
+	sanitized := strings.Join(labels, ".")
+	if delegation.Subdomain != "" {
+		return sanitized + "." + delegation.Subdomain + "." + delegation.TargetZone
+	}
+	return sanitized + "." + delegation.TargetZone
+}
+
+// recordNameForChallenge returns the Record CR name for a single challenge
+// on fqdn: getRecordName(fqdn) suffixed with a short hash of key. Giving
+// each challenge its own CR (rather than sharing one per FQDN) means
+// concurrent challenges for the same FQDN, such as a wildcard and its apex,
+// each get their own real TXT value instead of clobbering each other.
+func recordNameForChallenge(fqdn, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return getRecordName(fqdn) + "-" + hex.EncodeToString(sum[:])[:8]
 }
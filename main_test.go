@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	dnsv1 "github.com/xzzpig/kube-dns-manager/api/dns/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestSolver(t *testing.T) *customDNSProviderSolver {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := dnsv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to register scheme: %v", err)
+	}
+	return &customDNSProviderSolver{
+		name:   "kube-dns-manager",
+		client: fake.NewClientBuilder().WithScheme(scheme).Build(),
+	}
+}
+
+func recordValue(t *testing.T, s *customDNSProviderSolver, ch *v1alpha1.ChallengeRequest) (string, bool) {
+	t.Helper()
+	record := dnsv1.Record{}
+	name := recordNameForChallenge(strings.TrimSuffix(ch.ResolvedFQDN, "."), ch.Key)
+	err := s.client.Get(context.Background(), client.ObjectKey{Namespace: ch.ResourceNamespace, Name: name}, &record)
+	if apierrors.IsNotFound(err) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("unexpected error getting record %s: %v", name, err)
+	}
+	return record.Spec.Value, true
+}
+
+// TestPresentConcurrentChallengesDoNotClobber calls Present twice with
+// different keys for the same FQDN (e.g. a wildcard and its apex) and
+// asserts both keys survive until their respective CleanUps.
+func TestPresentConcurrentChallengesDoNotClobber(t *testing.T) {
+	s := newTestSolver(t)
+
+	chA := &v1alpha1.ChallengeRequest{
+		UID:               types.UID("uid-a"),
+		ResolvedFQDN:      "_acme-challenge.example.com.",
+		ResourceNamespace: "default",
+		Key:               "key-a",
+	}
+	chB := &v1alpha1.ChallengeRequest{
+		UID:               types.UID("uid-b"),
+		ResolvedFQDN:      "_acme-challenge.example.com.",
+		ResourceNamespace: "default",
+		Key:               "key-b",
+	}
+
+	if err := s.Present(chA); err != nil {
+		t.Fatalf("Present(chA) failed: %v", err)
+	}
+	if err := s.Present(chB); err != nil {
+		t.Fatalf("Present(chB) failed: %v", err)
+	}
+
+	if value, ok := recordValue(t, s, chA); !ok || value != chA.Key {
+		t.Fatalf("record for chA = %q, ok=%v; want %q, true", value, ok, chA.Key)
+	}
+	if value, ok := recordValue(t, s, chB); !ok || value != chB.Key {
+		t.Fatalf("record for chB = %q, ok=%v; want %q, true", value, ok, chB.Key)
+	}
+
+	if err := s.CleanUp(chA); err != nil {
+		t.Fatalf("CleanUp(chA) failed: %v", err)
+	}
+	if _, ok := recordValue(t, s, chA); ok {
+		t.Fatalf("record for chA still exists after CleanUp(chA)")
+	}
+	if value, ok := recordValue(t, s, chB); !ok || value != chB.Key {
+		t.Fatalf("CleanUp(chA) clobbered chB's record: value = %q, ok=%v; want %q, true", value, ok, chB.Key)
+	}
+
+	if err := s.CleanUp(chB); err != nil {
+		t.Fatalf("CleanUp(chB) failed: %v", err)
+	}
+	if _, ok := recordValue(t, s, chB); ok {
+		t.Fatalf("record for chB still exists after CleanUp(chB)")
+	}
+}
+
+// TestDelegatedFQDNDoesNotCollideAcrossDomains asserts that two distinct
+// FQDNs which previously flattened to the same label (because every
+// separating dot was replaced with a dash) now resolve to different
+// delegated targets.
+func TestDelegatedFQDNDoesNotCollideAcrossDomains(t *testing.T) {
+	delegation := &cnameDelegationConfig{TargetZone: "acme.internal.example.net"}
+
+	a := delegatedFQDN("_acme-challenge.foo.bar.com", delegation)
+	b := delegatedFQDN("_acme-challenge.foo-bar.com", delegation)
+
+	if a == b {
+		t.Fatalf("delegatedFQDN collided for distinct FQDNs: both produced %q", a)
+	}
+}